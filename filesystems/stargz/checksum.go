@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/crfs/stargz"
+
+	"github.com/carmark/stargz-snapshotter/pkg/contenthash"
+)
+
+// tocSource adapts a stargz.Reader to contenthash.Source so a Tree can walk
+// it without ever fetching a chunk's body: every regular-file TOCEntry
+// already carries the digest the stargz writer computed for it.
+type tocSource struct {
+	r *stargz.Reader
+}
+
+func (s tocSource) Lookup(p string) (contenthash.SourceEntry, bool) {
+	e, ok := s.r.Lookup(strings.TrimPrefix(p, "/"))
+	if !ok {
+		return contenthash.SourceEntry{}, false
+	}
+
+	xattrs := make(map[string]string, len(e.Xattrs))
+	for k, v := range e.Xattrs {
+		xattrs[k] = string(v)
+	}
+
+	var children []string
+	e.ForeachChild(func(baseName string, _ *stargz.TOCEntry) bool {
+		children = append(children, baseName)
+		return true
+	})
+
+	return contenthash.SourceEntry{
+		IsDir:    e.Type == "dir",
+		Digest:   e.Digest,
+		Mode:     e.Mode,
+		UID:      e.UID,
+		GID:      e.GID,
+		Xattrs:   xattrs,
+		Children: children,
+	}, true
+}
+
+// tree lazily builds (and memoizes) the content-hash index for this blob.
+func (gr *stargzReader) tree() *contenthash.Tree {
+	gr.treeOnce.Do(func() {
+		gr.treeV = contenthash.NewTree(tocSource{r: gr.r})
+	})
+	return gr.treeV
+}
+
+// Checksum returns the digest of the single file or directory header at
+// name, without fetching any file bodies beyond what the TOC already
+// records.
+func (gr *stargzReader) Checksum(ctx context.Context, name string) (string, error) {
+	return gr.tree().Checksum(ctx, name)
+}
+
+// ChecksumSubtree returns the digest of name and everything beneath it, so
+// that FUSE nodes and cache-blob chunks carrying an identical digest across
+// layers can be safely reused.
+func (gr *stargzReader) ChecksumSubtree(ctx context.Context, name string) (string, error) {
+	return gr.tree().ChecksumSubtree(ctx, name)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/crfs/stargz"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/carmark/stargz-snapshotter/pkg/contenthash"
+)
+
+// cache abstracts the blob store used to avoid re-fetching file contents
+// that have already been read once.
+type cache interface {
+	// Fetch fetches a blob of the given digest from the cache.
+	Fetch(digest string) (p []byte, ok bool)
+
+	// Add adds the given blob to the cache.
+	Add(digest string, p []byte)
+}
+
+// stargzReader serves the content of a single stargz blob, translating
+// path lookups into the blob's TOC and reading file bodies straight out of
+// the blob; cache is not consulted by node.Open.
+type stargzReader struct {
+	digest string
+	r      *stargz.Reader
+	cache  cache
+
+	// whiteoutMode controls how whiteouts stored in the TOC are presented
+	// to FUSE callers. The zero value is AUFSInOverlayOut.
+	whiteoutMode WhiteoutMode
+
+	// treeOnce/treeV lazily build the contenthash.Tree backing Checksum and
+	// ChecksumSubtree; see checksum.go.
+	treeOnce sync.Once
+	treeV    *contenthash.Tree
+}
+
+// node is an fs.InodeEmbedder backed by a stargz TOCEntry. The same type is
+// used for every entry kind stargzReader can produce (regular files,
+// directories, symlinks, hardlinks and device/fifo special files); behavior
+// is switched on e.Type where it matters.
+type node struct {
+	fs.Inode
+	gr *stargzReader
+	e  *stargz.TOCEntry
+}
+
+var (
+	_ fs.InodeEmbedder   = (*node)(nil)
+	_ fs.NodeLookuper    = (*node)(nil)
+	_ fs.NodeReaddirer   = (*node)(nil)
+	_ fs.NodeGetattrer   = (*node)(nil)
+	_ fs.NodeReadlinker  = (*node)(nil)
+	_ fs.NodeGetxattrer  = (*node)(nil)
+	_ fs.NodeListxattrer = (*node)(nil)
+	_ fs.NodeOpener      = (*node)(nil)
+)
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillAttrFromTOCEntry(&out.Attr, n.e)
+	return 0
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	overlayOut := n.gr.whiteoutMode.overlayOut()
+	if overlayOut && (name == opaqueEntryName || strings.HasPrefix(name, whiteoutPrefix)) {
+		// These are synthetic/control entries; they must never be looked up
+		// as regular children.
+		return nil, syscall.ENOENT
+	}
+
+	if ce, ok := n.e.LookupChild(name); ok {
+		target, ok := n.gr.resolveHardlink(ce)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		fillAttrFromTOCEntry(&out.Attr, target)
+		child := n.NewInode(ctx, &node{gr: n.gr, e: target}, stableAttr(target))
+		return child, 0
+	}
+
+	// Fall back to an AUFS-style whiteout for this name, unless this mode
+	// wants AUFS whiteouts served unconverted (they're then only reachable
+	// under their literal ".wh."-prefixed name, handled by LookupChild
+	// above).
+	if overlayOut {
+		if we, ok := n.e.LookupChild(whiteoutPrefix + name); ok {
+			fillWhiteoutAttr(&out.Attr)
+			child := n.NewInode(ctx, &whiteout{oe: we}, fs.StableAttr{Mode: syscall.S_IFCHR, Ino: inoOf(we)})
+			return child, 0
+		}
+	}
+
+	return nil, syscall.ENOENT
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	overlayOut := n.gr.whiteoutMode.overlayOut()
+	var ents []fuse.DirEntry
+	n.e.ForeachChild(func(baseName string, ent *stargz.TOCEntry) bool {
+		switch {
+		case overlayOut && baseName == opaqueEntryName:
+			// surfaced as an xattr on this node, not as a directory entry.
+			return true
+		case overlayOut && strings.HasPrefix(baseName, whiteoutPrefix):
+			name := baseName[len(whiteoutPrefix):]
+			if _, shadowed := n.e.LookupChild(name); shadowed {
+				// A real entry with this name already exists (the whiteout
+				// is redundant for in-layer lookups); don't list it twice.
+				return true
+			}
+			ents = append(ents, fuse.DirEntry{Mode: syscall.S_IFCHR, Name: name, Ino: inoOf(ent)})
+		default:
+			ents = append(ents, fuse.DirEntry{Mode: toSyscallMode(ent), Name: baseName, Ino: inoOf(ent)})
+		}
+		return true
+	})
+	return fs.NewListDirStream(ents), 0
+}
+
+// Readlink returns the target of a symlink entry. It is invalid to call
+// this on anything else.
+func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.e.Type != "symlink" {
+		return nil, syscall.EINVAL
+	}
+	return []byte(n.e.Linkname), 0
+}
+
+// Listxattr surfaces every xattr the TOC entry carries, whatever namespace
+// it's in (user.*, security.*, trusted.*, ...) - stargz stores them exactly
+// as they appeared in the source tar's PAX records, so no namespace
+// filtering is needed here.
+func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []string
+	for k := range n.e.Xattrs {
+		names = append(names, k)
+	}
+	if n.isOpaque() {
+		names = append(names, opaqueXattr)
+	}
+	return copyXattrList(names, dest)
+}
+
+// Getxattr returns the raw bytes stored for attr, untouched: this is what
+// lets a binary security.capability blob (or any other non-UTF8 xattr
+// value) survive the tar->stargz->FUSE path byte-for-byte.
+func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr == opaqueXattr && n.isOpaque() {
+		return copyXattrValue([]byte(opaqueXattrValue), dest)
+	}
+	if v, ok := n.e.Xattrs[attr]; ok {
+		return copyXattrValue(v, dest)
+	}
+	return 0, syscall.ENODATA
+}
+
+// isOpaque reports whether this node should be treated as OverlayFS-opaque,
+// either because it already carries the native xattr or because this mode
+// converts its AUFS ".wh..wh..opq" marker to one.
+func (n *node) isOpaque() bool {
+	if n.gr.whiteoutMode.overlayOut() {
+		if _, ok := n.e.LookupChild(opaqueEntryName); ok {
+			return true
+		}
+	}
+	return string(n.e.Xattrs[opaqueXattr]) == opaqueXattrValue
+}
+
+// Open serves regular file content straight out of the stargz blob; since
+// the blob is fetched as a whole in these tests no caching is required, but
+// stargzReader.cache is where a real snapshotter would place bytes it has
+// pulled from the remote registry.
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if n.e.Type != "reg" {
+		return nil, 0, syscall.EISDIR
+	}
+	ra, err := n.gr.r.OpenFile(n.e.Name)
+	if err != nil {
+		return nil, 0, syscall.EIO
+	}
+	return &regFile{ra: ra}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// regFile is the fs.FileHandle returned by node.Open for regular files.
+type regFile struct {
+	ra io.ReaderAt
+}
+
+var _ fs.FileReader = (*regFile)(nil)
+
+func (f *regFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := f.ra.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// resolveHardlink follows a "hardlink"-typed TOCEntry to the entry it
+// points at, so that callers always see the content (digest, size, mode)
+// of the underlying file rather than the empty link record itself.
+func (gr *stargzReader) resolveHardlink(e *stargz.TOCEntry) (*stargz.TOCEntry, bool) {
+	if e.Type != "hardlink" {
+		return e, true
+	}
+	return gr.r.Lookup(e.Linkname)
+}
+
+// stableAttr derives the fs.StableAttr a TOCEntry's inode should use. Ino is
+// a deterministic hash of the entry's canonical (hardlink-resolved) name, so
+// that every path leading to the same content shares one kernel inode, as
+// required for correct hardlink (st_nlink > 1) semantics.
+func stableAttr(e *stargz.TOCEntry) fs.StableAttr {
+	return fs.StableAttr{Mode: toSyscallMode(e), Ino: inoOf(e)}
+}
+
+func inoOf(e *stargz.TOCEntry) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, e.Name)
+	return h.Sum64()
+}
+
+func fillAttrFromTOCEntry(out *fuse.Attr, e *stargz.TOCEntry) {
+	out.Size = uint64(e.Size)
+	out.Mode = toSyscallMode(e)
+	out.Nlink = 1
+	if e.NumLink > 1 {
+		out.Nlink = uint32(e.NumLink)
+	}
+	switch e.Type {
+	case "char", "block":
+		out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
+	}
+}
+
+func toSyscallMode(e *stargz.TOCEntry) uint32 {
+	switch e.Type {
+	case "dir":
+		return syscall.S_IFDIR | uint32(e.Mode)
+	case "symlink":
+		return syscall.S_IFLNK | uint32(e.Mode)
+	case "char":
+		return syscall.S_IFCHR | uint32(e.Mode)
+	case "block":
+		return syscall.S_IFBLK | uint32(e.Mode)
+	case "fifo":
+		return syscall.S_IFIFO | uint32(e.Mode)
+	default:
+		return syscall.S_IFREG | uint32(e.Mode)
+	}
+}
+
+// copyXattrValue implements the go-fuse v2 Getxattr convention: copy v into
+// dest if it fits, otherwise report the size needed via ERANGE.
+func copyXattrValue(v []byte, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), 0
+}
+
+// copyXattrList implements the go-fuse v2 Listxattr convention: a
+// NUL-separated list of names.
+func copyXattrList(names []string, dest []byte) (uint32, syscall.Errno) {
+	size := 0
+	for _, name := range names {
+		size += len(name) + 1
+	}
+	if len(dest) < size {
+		return uint32(size), syscall.ERANGE
+	}
+	off := 0
+	for _, name := range names {
+		off += copy(dest[off:], name)
+		dest[off] = 0
+		off++
+	}
+	return uint32(size), 0
+}
+
+// whiteout represents an AUFS-style whiteout (".wh.<name>") surfaced to
+// FUSE callers as a char device with major/minor 0,0, matching what the
+// OverlayFS kernel driver expects to see.
+type whiteout struct {
+	fs.Inode
+	oe *stargz.TOCEntry
+}
+
+var (
+	_ fs.InodeEmbedder = (*whiteout)(nil)
+	_ fs.NodeGetattrer = (*whiteout)(nil)
+)
+
+func (w *whiteout) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fillWhiteoutAttr(&out.Attr)
+	return 0
+}
+
+func fillWhiteoutAttr(out *fuse.Attr) {
+	out.Mode = syscall.S_IFCHR
+	out.Rdev = uint32(unix.Mkdev(0, 0))
+	out.Nlink = 1
+}
@@ -3,18 +3,20 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
-	"time"
 
 	"github.com/google/crfs/stargz"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fs"
 	"golang.org/x/sys/unix"
 )
 
@@ -88,49 +90,482 @@ func TestWhiteout(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tr, cancel := buildTarGz(t, tt.in)
-			defer cancel()
-			var stargzBuf bytes.Buffer
-			w := stargz.NewWriter(&stargzBuf)
-			if err := w.AppendTar(tr); err != nil {
-				t.Fatalf("Append: %v", err)
+			tc := mountStargz(t, tt.in)
+			for _, want := range tt.want {
+				want.check(t, tc)
 			}
-			if err := w.Close(); err != nil {
-				t.Fatalf("Writer.Close: %v", err)
+		})
+	}
+}
+
+func TestEntryTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []tarEntry
+		want []fsCheck
+	}{
+		{
+			name: "symlink",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+				symlink("foo/bar.link", "bar.txt"),
+			),
+			want: checks(
+				hasSymlink("foo/bar.link", "bar.txt"),
+				hasFileDigest("foo/bar.txt", digestFor("test")),
+			),
+		},
+		{
+			name: "hardlink",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+				hardlink("foo/bar.hardlink", "foo/bar.txt"),
+			),
+			want: checks(
+				hasHardlinkTo("foo/bar.hardlink", "foo/bar.txt"),
+			),
+		},
+		{
+			name: "chardev",
+			in: tarOf(
+				dir("foo/"),
+				chardev("foo/null", 1, 3),
+			),
+			want: checks(
+				hasDevice("foo/null", 1, 3),
+			),
+		},
+		{
+			name: "blockdev",
+			in: tarOf(
+				dir("foo/"),
+				blockdev("foo/loop0", 7, 0),
+			),
+			want: checks(
+				hasDevice("foo/loop0", 7, 0),
+			),
+		},
+		{
+			name: "fifo",
+			in: tarOf(
+				dir("foo/"),
+				fifo("foo/pipe"),
+			),
+			want: checks(
+				hasFifo("foo/pipe"),
+			),
+		},
+		{
+			name: "empty_dir",
+			in: tarOf(
+				dir("foo/"),
+				dir("foo/empty/"),
+			),
+			want: checks(
+				hasNumEnts("foo/empty", 0),
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := mountStargz(t, tt.in)
+			for _, want := range tt.want {
+				want.check(t, tc)
 			}
-			b := stargzBuf.Bytes()
+		})
+	}
+}
 
-			r, err := stargz.Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
-			if err != nil {
-				t.Fatalf("stargz.Open: %v", err)
+func TestWhiteoutConversion(t *testing.T) {
+	tests := []struct {
+		name string
+		mode WhiteoutMode
+		in   []tarEntry
+		want []fsCheck
+	}{
+		{
+			// Overlay-formatted input is canonicalized to AUFS at write time
+			// and converted back to OverlayFS form at read time, so the
+			// observable result matches AUFSInOverlayOut.
+			name: "overlay_in_overlay_out",
+			mode: OverlayInOverlayOut,
+			in: tarOf(
+				dir("foo/", xAttr{opaqueXattr: opaqueXattrValue}),
+				chardev("foo/bar.txt", 0, 0),
+			),
+			want: checks(
+				hasValidWhiteout("foo/bar.txt"),
+				hasNodeXattrs("foo/", opaqueXattr, opaqueXattrValue),
+				fileNotExist("foo/.wh.bar.txt"),
+			),
+		},
+		{
+			// AUFS-formatted input served unconverted: the marker files
+			// themselves are visible as plain (empty) regular files.
+			name: "aufs_in_aufs_out",
+			mode: AUFSInAUFSOut,
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/.wh.bar.txt", ""),
+				regfile("foo/.wh..wh..opq", ""),
+			),
+			want: checks(
+				hasFileDigest("foo/.wh.bar.txt", digestFor("")),
+				hasFileDigest("foo/.wh..wh..opq", digestFor("")),
+				fileNotExist("foo/bar.txt"),
+			),
+		},
+		{
+			// Passthrough never synthesizes or hides anything, regardless of
+			// which convention (or mixture of both) the source layer used.
+			name: "passthrough_mixed_source",
+			mode: Passthrough,
+			in: tarOf(
+				dir("foo/", xAttr{opaqueXattr: opaqueXattrValue}),
+				regfile("foo/.wh.bar.txt", ""),
+			),
+			want: checks(
+				hasFileDigest("foo/.wh.bar.txt", digestFor("")),
+				hasNodeXattrs("foo/", opaqueXattr, opaqueXattrValue),
+				fileNotExist("foo/bar.txt"),
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := mountStargzWithMode(t, tt.in, tt.mode)
+			for _, want := range tt.want {
+				want.check(t, tc)
 			}
-			root, ok := r.Lookup("")
-			if !ok {
-				t.Fatalf("failed to find root in stargz")
+		})
+	}
+}
+
+func TestSecurityXattrs(t *testing.T) {
+	// A fabricated vfs_cap_data-shaped blob: a version/magic word followed
+	// by raw, non-UTF8 permitted/inheritable/effective bitmasks. What
+	// matters here isn't that it's a valid capability set, only that every
+	// byte - including the high ones - survives the tar->stargz->FUSE round
+	// trip unchanged.
+	capBlob := "\x00\x00\x00\x02\xff\x00\x00\x00\x00\x00\x00\x00\xab\xcd\xef\x01\x00\x00\x00\x00"
+	selinuxLabel := "system_u:object_r:container_file_t:s0:c123,c456"
+
+	tests := []struct {
+		name string
+		in   []tarEntry
+		want []fsCheck
+	}{
+		{
+			name: "capability_and_selinux_on_file",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar", "test", xAttr{
+					"security.capability": capBlob,
+					"security.selinux":    selinuxLabel,
+				}),
+			),
+			want: checks(
+				hasNodeXattrs("foo/bar", "security.capability", capBlob),
+				hasNodeXattrs("foo/bar", "security.selinux", selinuxLabel),
+				hasFileDigest("foo/bar", digestFor("test")),
+			),
+		},
+		{
+			// Security xattrs must keep working even on a directory that is
+			// also carrying (and converting) an AUFS opaque whiteout marker.
+			name: "survives_whiteout_conversion",
+			in: tarOf(
+				dir("foo/", xAttr{"security.selinux": selinuxLabel}),
+				regfile("foo/.wh..wh..opq", ""),
+				regfile("foo/bar", "test", xAttr{"security.capability": capBlob}),
+			),
+			want: checks(
+				hasNodeXattrs("foo/", "security.selinux", selinuxLabel),
+				hasNodeXattrs("foo/", opaqueXattr, opaqueXattrValue),
+				hasNodeXattrs("foo/bar", "security.capability", capBlob),
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := mountStargz(t, tt.in)
+			for _, want := range tt.want {
+				want.check(t, tc)
 			}
-			gr := &stargzReader{
-				digest: "test",
-				r:      r,
-				cache:  &testCache{membuf: map[string]string{}, t: t},
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []tarEntry
+		path string
+	}{
+		{
+			name: "file",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+			),
+			path: "foo/bar.txt",
+		},
+		{
+			name: "subtree",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+				dir("foo/baz/"),
+				regfile("foo/baz/qux.txt", "hello"),
+			),
+			path: "foo",
+		},
+		{
+			// xattr map iteration order must not leak into the digest.
+			name: "xattr_key_order_stable",
+			in: tarOf(
+				dir("foo/", xAttr{"b": "2", "a": "1", "c": "3"}),
+				regfile("foo/bar.txt", "test"),
+			),
+			path: "foo",
+		},
+		{
+			// a trailing slash on the queried path must not change the result.
+			name: "trailing_slash_normalized",
+			in: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+			),
+			path: "foo/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := mountStargz(t, tt.in)
+			want := expectedSubtreeDigest(t, tt.in, tt.path)
+			hasSubtreeDigest(tt.path, want).check(t, tc)
+		})
+	}
+}
+
+// TestContentHashDistinguishesMetadata guards against a digest that only
+// covers content/xattrs: a mode or ownership change must never be mistaken
+// for an unchanged entry, or a cached FUSE node/cache-blob chunk could be
+// reused across a permission change.
+func TestContentHashDistinguishesMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    []tarEntry
+		changed []tarEntry
+		path    string
+	}{
+		{
+			name: "file_mode",
+			base: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+			),
+			changed: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test", fileMode(0600)),
+			),
+			path: "foo/bar.txt",
+		},
+		{
+			name: "dir_mode",
+			base: tarOf(
+				dir("foo/"),
+				regfile("foo/bar.txt", "test"),
+			),
+			changed: tarOf(
+				dir("foo/", fileMode(0700)),
+				regfile("foo/bar.txt", "test"),
+			),
+			path: "foo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := mountStargz(t, tt.base)
+			after := mountStargz(t, tt.changed)
+
+			d1, err := before.gr.ChecksumSubtree(context.Background(), tt.path)
+			if err != nil {
+				t.Fatalf("ChecksumSubtree(%q): %v", tt.path, err)
 			}
-			rootNode := &node{
-				Node: nodefs.NewDefaultNode(),
-				gr:   gr,
-				e:    root,
+			d2, err := after.gr.ChecksumSubtree(context.Background(), tt.path)
+			if err != nil {
+				t.Fatalf("ChecksumSubtree(%q): %v", tt.path, err)
 			}
-			_ = nodefs.NewFileSystemConnector(rootNode, &nodefs.Options{
-				NegativeTimeout: 0,
-				AttrTimeout:     time.Second,
-				EntryTimeout:    time.Second,
-				Owner:           nil, // preserve owners.
-			})
-			for _, want := range tt.want {
-				want.check(t, rootNode)
+			if d1 == d2 {
+				t.Errorf("ChecksumSubtree(%q) unchanged after a metadata-only edit: both %q", tt.path, d1)
 			}
 		})
 	}
 }
 
+// expectedSubtreeDigest independently recomputes the digest that
+// stargzReader.ChecksumSubtree should report for path, working straight
+// from the input tarEntry list rather than through pkg/contenthash, so a
+// bug shared between the production code and this helper can't hide a
+// regression.
+func expectedSubtreeDigest(t *testing.T, ents []tarEntry, path string) string {
+	tr, cancel := buildTarGz(t, ents)
+	defer cancel()
+
+	type built struct {
+		isDir    bool
+		content  string
+		mode     int64
+		uid, gid int
+		xattrs   map[string]string
+		children []string
+	}
+	byPath := map[string]*built{"": {isDir: true}}
+
+	r := tar.NewReader(tr)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar built from ents: %v", err)
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("reading tar built from ents: %v", err)
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		byPath[name] = &built{
+			isDir:   hdr.Typeflag == tar.TypeDir,
+			content: string(content),
+			mode:    hdr.Mode,
+			uid:     hdr.Uid,
+			gid:     hdr.Gid,
+			xattrs:  hdr.Xattrs,
+		}
+		dir := filepath.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		byPath[dir].children = append(byPath[dir].children, filepath.Base(name))
+	}
+
+	var digest func(string) string
+	digest = func(p string) string {
+		e := byPath[p]
+		if !e.isDir {
+			hh := sha256.New()
+			fmt.Fprintf(hh, "file mode=%o uid=%d gid=%d\n", e.mode, e.uid, e.gid)
+			fmt.Fprintf(hh, "content %s\n", digestFor(e.content))
+			return fmt.Sprintf("sha256:%x", hh.Sum(nil))
+		}
+
+		keys := make([]string, 0, len(e.xattrs))
+		for k := range e.xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		hh := sha256.New()
+		fmt.Fprintf(hh, "dir mode=%o uid=%d gid=%d\n", e.mode, e.uid, e.gid)
+		for _, k := range keys {
+			fmt.Fprintf(hh, "xattr %s=%s\n", k, e.xattrs[k])
+		}
+		header := fmt.Sprintf("sha256:%x", hh.Sum(nil))
+
+		children := append([]string(nil), e.children...)
+		sort.Strings(children)
+		h := sha256.New()
+		fmt.Fprintf(h, "dir %s\n", header)
+		for _, c := range children {
+			child := c
+			if p != "" {
+				child = p + "/" + c
+			}
+			fmt.Fprintf(h, "%s %s\n", c, digest(child))
+		}
+		return fmt.Sprintf("sha256:%x", h.Sum(nil))
+	}
+
+	return digest(strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/"))
+}
+
+// testContext bundles everything an fsCheck needs: the real, mounted path to
+// drive with os/syscall calls, and the underlying stargzReader for the APIs
+// (like ChecksumSubtree) that aren't exposed through the filesystem itself.
+type testContext struct {
+	mountpoint string
+	gr         *stargzReader
+}
+
+func (tc *testContext) path(name string) string {
+	return filepath.Join(tc.mountpoint, name)
+}
+
+// mountStargz packs ents into a stargz blob, mounts the resulting FUSE
+// filesystem under a fresh t.TempDir(), and unmounts it during test
+// cleanup.
+func mountStargz(t *testing.T, ents []tarEntry) *testContext {
+	return mountStargzWithMode(t, ents, AUFSInOverlayOut)
+}
+
+// mountStargzWithMode is mountStargz with an explicit WhiteoutMode. When
+// mode expects OverlayFS-style whiteouts on input, ents are canonicalized to
+// the AUFS convention before being packed into the TOC, matching what the
+// real writer path does.
+func mountStargzWithMode(t *testing.T, ents []tarEntry, mode WhiteoutMode) *testContext {
+	tr, cancel := buildTarGz(t, ents)
+	defer cancel()
+	if mode.convertsInput() {
+		tr = canonicalizeWhiteouts(tr)
+	}
+	var stargzBuf bytes.Buffer
+	w := stargz.NewWriter(&stargzBuf)
+	if err := w.AppendTar(tr); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Writer.Close: %v", err)
+	}
+	b := stargzBuf.Bytes()
+
+	r, err := stargz.Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	root, ok := r.Lookup("")
+	if !ok {
+		t.Fatalf("failed to find root in stargz")
+	}
+	gr := &stargzReader{
+		digest:       "test",
+		r:            r,
+		cache:        &testCache{membuf: map[string]string{}, t: t},
+		whiteoutMode: mode,
+	}
+	rootNode := &node{gr: gr, e: root}
+
+	mountpoint := t.TempDir()
+	server, err := fs.Mount(mountpoint, rootNode, &fs.Options{})
+	if err != nil {
+		t.Fatalf("mounting stargz at %s: %v", mountpoint, err)
+	}
+	t.Cleanup(func() {
+		if err := server.Unmount(); err != nil {
+			t.Logf("unmounting %s: %v", mountpoint, err)
+		}
+	})
+	return &testContext{mountpoint: mountpoint, gr: gr}
+}
+
 func buildTarGz(t *testing.T, ents []tarEntry) (r io.Reader, cancel func()) {
 	pr, pw := io.Pipe()
 	go func() {
@@ -163,16 +598,29 @@ type tarEntryFunc func(*tar.Writer) error
 
 func (f tarEntryFunc) appendTar(tw *tar.Writer) error { return f(tw) }
 
-func regfile(name, contents string) tarEntry {
+func regfile(name, contents string, opts ...interface{}) tarEntry {
 	return tarEntryFunc(func(tw *tar.Writer) error {
 		if strings.HasSuffix(name, "/") {
 			return fmt.Errorf("bogus trailing slash in file %q", name)
 		}
+		var xattrs xAttr
+		mode := int64(0644)
+		for _, opt := range opts {
+			switch v := opt.(type) {
+			case xAttr:
+				xattrs = v
+			case fileMode:
+				mode = int64(v)
+			default:
+				return fmt.Errorf("unsupported opt")
+			}
+		}
 		if err := tw.WriteHeader(&tar.Header{
 			Typeflag: tar.TypeReg,
 			Name:     name,
-			Mode:     0644,
+			Mode:     mode,
 			Size:     int64(len(contents)),
+			Xattrs:   xattrs,
 		}); err != nil {
 			return err
 		}
@@ -184,10 +632,14 @@ func regfile(name, contents string) tarEntry {
 func dir(d string, opts ...interface{}) tarEntry {
 	return tarEntryFunc(func(tw *tar.Writer) error {
 		var xattrs xAttr
+		mode := int64(0755)
 		for _, opt := range opts {
-			if v, ok := opt.(xAttr); ok {
+			switch v := opt.(type) {
+			case xAttr:
 				xattrs = v
-			} else {
+			case fileMode:
+				mode = int64(v)
+			default:
 				return fmt.Errorf("unsupported opt")
 			}
 		}
@@ -198,176 +650,257 @@ func dir(d string, opts ...interface{}) tarEntry {
 		return tw.WriteHeader(&tar.Header{
 			Typeflag: tar.TypeDir,
 			Name:     name,
-			Mode:     0755,
+			Mode:     mode,
 			Xattrs:   xattrs,
 		})
 	})
 }
 
+func symlink(name, target string) tarEntry {
+	return tarEntryFunc(func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     name,
+			Linkname: target,
+			Mode:     0777,
+		})
+	})
+}
+
+func hardlink(name, target string) tarEntry {
+	return tarEntryFunc(func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     name,
+			Linkname: target,
+		})
+	})
+}
+
+func chardev(name string, major, minor int64) tarEntry {
+	return tarEntryFunc(func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeChar,
+			Name:     name,
+			Mode:     0644,
+			Devmajor: major,
+			Devminor: minor,
+		})
+	})
+}
+
+func blockdev(name string, major, minor int64) tarEntry {
+	return tarEntryFunc(func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeBlock,
+			Name:     name,
+			Mode:     0644,
+			Devmajor: major,
+			Devminor: minor,
+		})
+	})
+}
+
+func fifo(name string) tarEntry {
+	return tarEntryFunc(func(tw *tar.Writer) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeFifo,
+			Name:     name,
+			Mode:     0644,
+		})
+	})
+}
+
 type xAttr map[string]string
 
+// fileMode overrides a regfile/dir entry's default mode (0644/0755).
+type fileMode int64
+
 type fsCheck interface {
-	check(t *testing.T, root *node)
+	check(t *testing.T, tc *testContext)
 }
 
-type fsCheckFn func(*testing.T, *node)
+type fsCheckFn func(*testing.T, *testContext)
 
-func (f fsCheckFn) check(t *testing.T, root *node) { f(t, root) }
+func (f fsCheckFn) check(t *testing.T, tc *testContext) { f(t, tc) }
 
-func fileNotExist(file string) fsCheck {
-	return fsCheckFn(func(t *testing.T, root *node) {
-		ent, inode, err := getDirentAndNode(root, file)
-		if err == nil || ent != nil || inode != nil {
-			t.Errorf("Node %q exists", file)
+func fileNotExist(name string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		if _, err := os.Lstat(tc.path(name)); !os.IsNotExist(err) {
+			t.Errorf("Lstat(%q) = %v; want not-exist", name, err)
 		}
 	})
 }
 
-func hasFileDigest(file string, digest string) fsCheck {
-	return fsCheckFn(func(t *testing.T, root *node) {
-		_, inode, err := getDirentAndNode(root, file)
+func hasFileDigest(name string, digest string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		b, err := os.ReadFile(tc.path(name))
 		if err != nil {
-			t.Fatalf("failed to get node %q: %v", file, err)
+			t.Fatalf("failed to read %q: %v", name, err)
 		}
-		n, ok := inode.Node().(*node)
-		if !ok {
-			t.Fatalf("entry %q isn't a normal node", file)
-		}
-		if n.e.Digest != digest {
-			t.Fatalf("Digest(%q) = %q, want %q", file, n.e.Digest, digest)
+		if got := digestFor(string(b)); got != digest {
+			t.Errorf("Digest(%q) = %q, want %q", name, got, digest)
 		}
 	})
 }
 
 func hasValidWhiteout(name string) fsCheck {
-	return fsCheckFn(func(t *testing.T, root *node) {
-		ent, inode, err := getDirentAndNode(root, name)
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		fi, err := os.Lstat(tc.path(name))
 		if err != nil {
-			t.Fatalf("failed to get node %q: %v", name, err)
+			t.Fatalf("failed to stat %q: %v", name, err)
 		}
-		n, ok := inode.Node().(*whiteout)
+		st, ok := fi.Sys().(*syscall.Stat_t)
 		if !ok {
-			t.Fatalf("entry %q isn't a whiteout node", name)
-		}
-		var a fuse.Attr
-		if status := n.GetAttr(&a, nil, nil); status != fuse.OK {
-			t.Fatalf("failed to get attributes of file %q: %v", name, status)
+			t.Fatalf("failed to get raw stat_t for %q", name)
 		}
-		if a.Ino != ent.Ino {
-			t.Errorf("inconsistent inodes %d(Node) != %d(Dirent)", a.Ino, ent.Ino)
+		if fi.Mode()&os.ModeCharDevice == 0 {
+			t.Errorf("whiteout %q isn't a char device", name)
 			return
 		}
-
-		// validate the direntry
-		if ent.Mode != syscall.S_IFCHR {
-			t.Errorf("whiteout entry %q isn't a char device", name)
-			return
-		}
-
-		// validate the node
-		if a.Mode != syscall.S_IFCHR {
-			t.Errorf("whiteout %q has an invalid mode %o; want %o",
-				name, a.Mode, syscall.S_IFCHR)
-			return
-		}
-		if a.Rdev != uint32(unix.Mkdev(0, 0)) {
-			t.Errorf("whiteout %q has invalid device numbers (%d, %d); want (0, 0)",
-				name, unix.Major(uint64(a.Rdev)), unix.Minor(uint64(a.Rdev)))
-			return
+		major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+		if major != 0 || minor != 0 {
+			t.Errorf("whiteout %q has invalid device numbers (%d, %d); want (0, 0)", name, major, minor)
 		}
 	})
 }
 
-func hasNodeXattrs(entry, name, value string) fsCheck {
-	return fsCheckFn(func(t *testing.T, root *node) {
-		_, inode, err := getDirentAndNode(root, entry)
-		if err != nil {
-			t.Fatalf("failed to get node %q: %v", entry, err)
-		}
-		n, ok := inode.Node().(*node)
-		if !ok {
-			t.Fatalf("entry %q isn't a normal node", entry)
-		}
+func hasNodeXattrs(name, xattr, value string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		full := tc.path(name)
 
-		// check xattr exists in the xattrs list.
-		attrs, status := n.ListXAttr(nil)
-		if status != fuse.OK {
-			t.Fatalf("failed to get xattrs list of node %q: %v", entry, err)
+		buf := make([]byte, 4096)
+		n, err := unix.Llistxattr(full, buf)
+		if err != nil {
+			t.Fatalf("failed to list xattrs of %q: %v", name, err)
 		}
 		var found bool
-		for _, x := range attrs {
-			if x == name {
+		for _, x := range strings.Split(strings.Trim(string(buf[:n]), "\x00"), "\x00") {
+			if x == xattr {
 				found = true
 			}
 		}
 		if !found {
-			t.Errorf("node %q doesn't have an opaque xattr %q", entry, value)
+			t.Errorf("node %q doesn't have an xattr %q", name, xattr)
 			return
 		}
 
-		// check the xattr has valid value.
-		v, status := n.GetXAttr(name, nil)
-		if status != fuse.OK {
-			t.Fatalf("failed to get xattr %q of node %q: %v", name, entry, err)
+		vbuf := make([]byte, 4096)
+		vn, err := unix.Lgetxattr(full, xattr, vbuf)
+		if err != nil {
+			t.Fatalf("failed to get xattr %q of %q: %v", xattr, name, err)
 		}
-		if string(v) != value {
-			t.Errorf("node %q has an invalid xattr %q; want %q", entry, v, value)
-			return
+		if got := string(vbuf[:vn]); got != value {
+			t.Errorf("node %q has an invalid xattr %q = %q; want %q", name, xattr, got, value)
 		}
 	})
 }
 
-// getDirentAndNode gets dirent and node at the specified path at once and makes
-// sure that the both of them exist.
-func getDirentAndNode(root *node, path string) (ent *fuse.DirEntry, n *nodefs.Inode, err error) {
-	dir, base := filepath.Split(filepath.Clean(path))
+func hasSymlink(name, target string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		got, err := os.Readlink(tc.path(name))
+		if err != nil {
+			t.Fatalf("failed to read symlink %q: %v", name, err)
+		}
+		if got != target {
+			t.Errorf("Readlink(%q) = %q, want %q", name, got, target)
+		}
+	})
+}
 
-	// get the target's parent directory.
-	var attr fuse.Attr
-	d := root
-	for _, name := range strings.Split(dir, "/") {
-		if len(name) == 0 {
-			continue
+func hasHardlinkTo(name, target string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		a, err := os.Stat(tc.path(name))
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", name, err)
 		}
-		di, status := d.Lookup(&attr, name, nil)
-		if status != fuse.OK {
-			err = fmt.Errorf("failed to lookup directory %q: %v", name, status)
-			return
+		b, err := os.Stat(tc.path(target))
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", target, err)
 		}
-		var ok bool
-		if d, ok = di.Node().(*node); !ok {
-			err = fmt.Errorf("directory %q isn't a normal node", name)
-			return
+		if !os.SameFile(a, b) {
+			t.Errorf("%q isn't a hardlink to %q", name, target)
 		}
+	})
+}
 
-	}
+func hasDevice(name string, major, minor uint32) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		fi, err := os.Lstat(tc.path(name))
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", name, err)
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			t.Fatalf("failed to get raw stat_t for %q", name)
+		}
+		if gotMajor, gotMinor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)); gotMajor != major || gotMinor != minor {
+			t.Errorf("device %q has device numbers (%d, %d); want (%d, %d)", name, gotMajor, gotMinor, major, minor)
+		}
+	})
+}
 
-	// get the target's direntry.
-	var ents []fuse.DirEntry
-	ents, status := d.OpenDir(nil)
-	if status != fuse.OK {
-		err = fmt.Errorf("failed to open directory %q: %v", path, status)
-	}
-	var found bool
-	for _, e := range ents {
-		if e.Name == base {
-			ent, found = &e, true
+func hasFifo(name string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		fi, err := os.Lstat(tc.path(name))
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", name, err)
 		}
-	}
-	if !found {
-		err = fmt.Errorf("direntry %q not found in the parent directory of %q", base, path)
-	}
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			t.Errorf("%q has mode %v, want a FIFO", name, fi.Mode())
+		}
+	})
+}
 
-	// get the target's node.
-	n, status = d.Lookup(&attr, base, nil)
-	if status != fuse.OK {
-		err = fmt.Errorf("failed to lookup node %q: %v", path, status)
-	}
+func hasNumEnts(name string, num int) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		ents, err := os.ReadDir(tc.path(name))
+		if err != nil {
+			t.Fatalf("failed to read directory %q: %v", name, err)
+		}
+		if len(ents) != num {
+			t.Errorf("directory %q has %d entries, want %d", name, len(ents), num)
+		}
+	})
+}
 
-	return
+func hasSubtreeDigest(name, digest string) fsCheck {
+	return fsCheckFn(func(t *testing.T, tc *testContext) {
+		got, err := tc.gr.ChecksumSubtree(context.Background(), name)
+		if err != nil {
+			t.Fatalf("ChecksumSubtree(%q): %v", name, err)
+		}
+		if got != digest {
+			t.Errorf("ChecksumSubtree(%q) = %q, want %q", name, got, digest)
+		}
+	})
 }
 
 func digestFor(content string) string {
 	sum := sha256.Sum256([]byte(content))
 	return fmt.Sprintf("sha256:%x", sum)
 }
+
+// testCache is a no-frills in-memory cache implementation used by tests so
+// stargzReader doesn't need a real blob store to exercise the FUSE layer.
+type testCache struct {
+	mu     sync.Mutex
+	membuf map[string]string
+	t      *testing.T
+}
+
+func (tc *testCache) Fetch(digest string) ([]byte, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	p, ok := tc.membuf[digest]
+	return []byte(p), ok
+}
+
+func (tc *testCache) Add(digest string, p []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.membuf == nil {
+		tc.membuf = make(map[string]string)
+	}
+	tc.membuf[digest] = string(p)
+}
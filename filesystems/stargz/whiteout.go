@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueXattr    = "trusted.overlay.opaque"
+
+	opaqueXattrValue = "y"
+)
+
+// opaqueEntryName is the name crfs/stargz (and the AUFS whiteout format it
+// came from) uses to mark a directory as "opaque", i.e. hiding anything
+// that a lower layer may have placed below it.
+const opaqueEntryName = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// WhiteoutMode selects how whiteouts are read out of, and how they are
+// expected to arrive in, a stargz-backed layer.
+//
+// Layers are always stored in the TOC using the AUFS convention
+// (".wh.<name>" files and ".wh..wh..opq" opaque markers); the mode only
+// controls the conversion applied at the tar->TOC (write) boundary and at
+// the TOC->FUSE (read) boundary.
+type WhiteoutMode int
+
+const (
+	// AUFSInOverlayOut is the default: incoming layers use AUFS-style
+	// whiteouts, and the FUSE tree presents them as OverlayFS expects
+	// (char device 0/0, "trusted.overlay.opaque" xattr).
+	AUFSInOverlayOut WhiteoutMode = iota
+
+	// OverlayInOverlayOut accepts layers that already use OverlayFS-style
+	// whiteouts; they are converted to the AUFS convention before being
+	// packed into the TOC, and converted back to OverlayFS form when
+	// served over FUSE, so the net effect observed by FUSE callers is the
+	// same as AUFSInOverlayOut.
+	OverlayInOverlayOut
+
+	// AUFSInAUFSOut accepts AUFS-style whiteouts and serves them
+	// unconverted: ".wh.<name>" and ".wh..wh..opq" appear over FUSE as the
+	// plain (empty) regular files they are in the tar.
+	AUFSInAUFSOut
+
+	// Passthrough applies no whiteout conversion in either direction, so a
+	// layer is served exactly as its TOC stores it, whichever convention
+	// (or mixture of both) it uses. Its behavior is the same as
+	// AUFSInAUFSOut for every layer.
+	Passthrough
+)
+
+// overlayOut reports whether this mode should present whiteouts to FUSE
+// callers using the OverlayFS convention.
+func (m WhiteoutMode) overlayOut() bool {
+	switch m {
+	case AUFSInOverlayOut, OverlayInOverlayOut:
+		return true
+	default:
+		return false
+	}
+}
+
+// convertsInput reports whether this mode expects OverlayFS-style
+// whiteouts on input and needs them canonicalized to the AUFS convention
+// before being appended to the stargz writer.
+func (m WhiteoutMode) convertsInput() bool {
+	return m == OverlayInOverlayOut
+}
+
+// canonicalizeWhiteouts wraps tr, rewriting any OverlayFS-style whiteout it
+// finds (a char device with major/minor 0,0, or a directory carrying the
+// "trusted.overlay.opaque=y" xattr) into its AUFS equivalent, so that the
+// stargz TOC always stores whiteouts in one canonical format regardless of
+// how the source layer expressed them. Every other header field, including
+// any other xattr (security.capability, security.selinux, ...) a passed-
+// through entry carries, is copied verbatim.
+func canonicalizeWhiteouts(tr io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := func() error {
+			r := tar.NewReader(tr)
+			for {
+				hdr, err := r.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				if hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0 {
+					wh := &tar.Header{
+						Typeflag: tar.TypeReg,
+						Name:     whiteoutName(hdr.Name),
+						Mode:     hdr.Mode,
+					}
+					if err := tw.WriteHeader(wh); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if hdr.Typeflag == tar.TypeDir && hdr.Xattrs[opaqueXattr] == opaqueXattrValue {
+					delete(hdr.Xattrs, opaqueXattr)
+					delete(hdr.PAXRecords, "SCHILY.xattr."+opaqueXattr)
+					if err := tw.WriteHeader(hdr); err != nil {
+						return err
+					}
+					opq := &tar.Header{
+						Typeflag: tar.TypeReg,
+						Name:     filepath.Join(hdr.Name, opaqueEntryName),
+						Mode:     hdr.Mode,
+					}
+					if err := tw.WriteHeader(opq); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tw, r); err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("canonicalizing whiteouts: %w", err))
+			return
+		}
+		if err := tw.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// whiteoutName returns the AUFS whiteout name for the file at path.
+func whiteoutName(path string) string {
+	dir, base := filepath.Split(path)
+	return filepath.Join(dir, whiteoutPrefix+base)
+}
@@ -0,0 +1,190 @@
+// Package contenthash builds a per-image content-addressable index over a
+// stargz TOC, following the approach buildkit's contenthash package uses for
+// local build contexts: an immutable radix tree, keyed by cleaned absolute
+// path, that stores one digest per file and two digests per directory (a
+// header digest covering the directory's own metadata, and a subtree digest
+// covering it and everything beneath it). Every digest folds in the entry's
+// mode, uid and gid alongside its content digest (files) or xattrs
+// (directories), so a permission or ownership change is never mistaken for
+// an unchanged entry. A file's xattrs are not part of its digest.
+//
+// Digests are computed lazily and, as long as the source's entries already
+// carry a content digest (as stargz TOC entries do), without ever reading a
+// file's body: the tree only walks TOC metadata. Because tree updates are
+// copy-on-write, a *Tree reference keeps seeing a consistent snapshot even
+// while other paths are still being resolved, and unrelated subtrees are
+// never copied just because a sibling was just inserted.
+package contenthash
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+)
+
+// SourceEntry is the minimal view of a single TOC entry a Tree needs in
+// order to compute digests without fetching file bodies.
+type SourceEntry struct {
+	// IsDir reports whether this entry is a directory.
+	IsDir bool
+	// Digest is this entry's own content digest, already known from the
+	// source (e.g. a stargz TOC's per-file digest). Empty for directories.
+	Digest string
+	// Mode, UID and GID are the entry's permission bits and ownership.
+	Mode int64
+	UID  int
+	GID  int
+	// Xattrs holds this entry's extended attributes. Iteration order
+	// doesn't matter; the Tree normalizes it before hashing.
+	Xattrs map[string]string
+	// Children lists the names of this entry's direct descendants, in any
+	// order; the Tree sorts them before hashing.
+	Children []string
+}
+
+// Source looks up TOC entries by cleaned, slash-separated, absolute path
+// ("/", "/foo", "/foo/bar"). Implementations normalize trailing slashes
+// themselves.
+type Source interface {
+	Lookup(path string) (SourceEntry, bool)
+}
+
+// Tree is an immutable radix tree of lazily-computed content digests for a
+// single Source. It is safe for concurrent use: resolve reads and replaces
+// the root under a mutex, but never mutates a radixNode once built, so the
+// tree rooted at any previously-observed root stays valid and keeps sharing
+// structure with whatever it grows into.
+type Tree struct {
+	src Source
+
+	mu   sync.Mutex
+	root *radixNode
+}
+
+type entry struct {
+	digest        string // header digest for dirs, combined digest for files
+	subtreeDigest string // digest of this entry and everything beneath it
+}
+
+// NewTree returns a Tree backed by src. Nothing is computed until Checksum
+// or ChecksumSubtree is called.
+func NewTree(src Source) *Tree {
+	return &Tree{src: src}
+}
+
+// Checksum returns the digest of the single entry at p: its combined
+// mode/uid/gid/content digest for a file, or its header digest (metadata
+// only, not its contents) for a directory.
+func (t *Tree) Checksum(ctx context.Context, p string) (string, error) {
+	e, err := t.resolve(ctx, cleanPath(p))
+	if err != nil {
+		return "", err
+	}
+	return e.digest, nil
+}
+
+// ChecksumSubtree returns the digest of p and everything beneath it. Two
+// subtrees with equal ChecksumSubtree results have identical names, file
+// content digests, modes, ownership and directory xattrs, regardless of how
+// the source tar represented them (xattr iteration order, trailing slashes,
+// entry ordering, ...). File xattrs, and anything else a SourceEntry does
+// not carry, are not compared.
+func (t *Tree) ChecksumSubtree(ctx context.Context, p string) (string, error) {
+	e, err := t.resolve(ctx, cleanPath(p))
+	if err != nil {
+		return "", err
+	}
+	return e.subtreeDigest, nil
+}
+
+func (t *Tree) resolve(ctx context.Context, p string) (*entry, error) {
+	if e, ok := t.lookup(p); ok {
+		return e, nil
+	}
+
+	se, ok := t.src.Lookup(p)
+	if !ok {
+		return nil, fmt.Errorf("contenthash: no such entry %q", p)
+	}
+
+	if !se.IsDir {
+		e := &entry{digest: hashFile(se.Mode, se.UID, se.GID, se.Digest)}
+		e.subtreeDigest = e.digest
+		t.insert(p, e)
+		return e, nil
+	}
+
+	e := &entry{digest: hashHeader(se.Mode, se.UID, se.GID, se.Xattrs)}
+
+	children := append([]string(nil), se.Children...)
+	sort.Strings(children)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "dir %s\n", e.digest)
+	for _, c := range children {
+		ce, err := t.resolve(ctx, path.Join(p, c))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "%s %s\n", c, ce.subtreeDigest)
+	}
+	e.subtreeDigest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+
+	t.insert(p, e)
+	return e, nil
+}
+
+func (t *Tree) lookup(p string) (*entry, bool) {
+	t.mu.Lock()
+	root := t.root
+	t.mu.Unlock()
+	return radixGet(root, p)
+}
+
+func (t *Tree) insert(p string, e *entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root = radixInsert(t.root, p, e)
+}
+
+// hashFile computes a file's digest from its mode/uid/gid and its content
+// digest, so that a chmod or chown is never indistinguishable from a
+// content change.
+func hashFile(mode int64, uid, gid int, contentDigest string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "file mode=%o uid=%d gid=%d\n", mode, uid, gid)
+	fmt.Fprintf(h, "content %s\n", contentDigest)
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// hashHeader computes a directory's header digest from its mode/uid/gid and
+// xattrs; xattr keys are sorted so that Go's randomized map iteration never
+// changes the result.
+func hashHeader(mode int64, uid, gid int, xattrs map[string]string) string {
+	keys := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "dir mode=%o uid=%d gid=%d\n", mode, uid, gid)
+	for _, k := range keys {
+		fmt.Fprintf(h, "xattr %s=%s\n", k, xattrs[k])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cleanPath normalizes p to the absolute, trailing-slash-free form used as
+// tree keys, so "foo", "foo/", "/foo" and "/foo/" all resolve to the same
+// entry.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,121 @@
+package contenthash
+
+import "sort"
+
+// radixNode is one immutable node of the path-compressed radix tree backing
+// Tree. Updates never mutate a node in place: radixInsert returns a new root
+// that reuses every node and edge unaffected by the change, so a root
+// returned by an earlier insert remains valid (and keeps sharing structure
+// with later ones) even after the tree has moved on.
+type radixNode struct {
+	prefix string
+	leaf   *leafNode
+	edges  []radixEdge // partitioned by the first byte of each label
+}
+
+// radixEdge labels the edge from a node to a child with the portion of the
+// key consumed along it.
+type radixEdge struct {
+	label string
+	node  *radixNode
+}
+
+type leafNode struct {
+	val *entry
+}
+
+// radixGet looks up key in the tree rooted at n.
+func radixGet(n *radixNode, key string) (*entry, bool) {
+	for n != nil {
+		if !hasPrefix(key, n.prefix) {
+			return nil, false
+		}
+		key = key[len(n.prefix):]
+		if key == "" {
+			if n.leaf == nil {
+				return nil, false
+			}
+			return n.leaf.val, true
+		}
+		n = matchEdge(n.edges, key)
+	}
+	return nil, false
+}
+
+func matchEdge(edges []radixEdge, key string) *radixNode {
+	for _, e := range edges {
+		if e.label[0] == key[0] {
+			return e.node
+		}
+	}
+	return nil
+}
+
+// radixInsert returns a tree with key set to val, sharing every node and
+// edge of n that isn't on the path to key.
+func radixInsert(n *radixNode, key string, val *entry) *radixNode {
+	if n == nil {
+		return &radixNode{prefix: key, leaf: &leafNode{val: val}}
+	}
+
+	cpl := commonPrefixLen(n.prefix, key)
+	switch {
+	case cpl < len(n.prefix):
+		// n's prefix and key diverge partway through n's own prefix: split n
+		// into a shared parent holding the common part and n's remainder.
+		rest := &radixNode{prefix: n.prefix[cpl:], leaf: n.leaf, edges: n.edges}
+		parent := &radixNode{
+			prefix: n.prefix[:cpl],
+			edges:  []radixEdge{{label: rest.prefix, node: rest}},
+		}
+		if cpl == len(key) {
+			parent.leaf = &leafNode{val: val}
+		} else {
+			leaf := &radixNode{prefix: key[cpl:], leaf: &leafNode{val: val}}
+			parent.edges = sortEdges(append(parent.edges, radixEdge{label: leaf.prefix, node: leaf}))
+		}
+		return parent
+
+	case cpl == len(key):
+		// key ends exactly at n; replace n's leaf, keep its edges untouched.
+		return &radixNode{prefix: n.prefix, leaf: &leafNode{val: val}, edges: n.edges}
+
+	default:
+		// n's prefix is fully consumed; descend into (or add) the edge for
+		// what's left of key.
+		rest := key[cpl:]
+		edges := make([]radixEdge, len(n.edges))
+		copy(edges, n.edges)
+		for i, e := range edges {
+			if e.label[0] == rest[0] {
+				child := radixInsert(e.node, rest, val)
+				edges[i] = radixEdge{label: child.prefix, node: child}
+				return &radixNode{prefix: n.prefix, leaf: n.leaf, edges: edges}
+			}
+		}
+		leaf := &radixNode{prefix: rest, leaf: &leafNode{val: val}}
+		edges = sortEdges(append(edges, radixEdge{label: rest, node: leaf}))
+		return &radixNode{prefix: n.prefix, leaf: n.leaf, edges: edges}
+	}
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
+
+func commonPrefixLen(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func sortEdges(edges []radixEdge) []radixEdge {
+	sort.Slice(edges, func(i, j int) bool { return edges[i].label[0] < edges[j].label[0] })
+	return edges
+}